@@ -0,0 +1,418 @@
+package kcpraw
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	autoTuneMinParity     = 0
+	autoTuneMaxParity     = 10
+	autoTuneQuietRounds   = 3
+	autoTuneSampleWindow  = time.Second
+	autoTuneLossThreshold = 0.05 // fraction of packets lost before raising parity
+	autoTuneProbeWnd      = 256
+	autoTuneDrainWnd      = 16
+	dupDetectorWindow     = 16 // recent outgoing payload hashes kept per source
+)
+
+var (
+	autoTuneEnabled bool
+	autoTuneLock    sync.Mutex
+)
+
+// SetAutoTune enables or disables the BBR-style self-tuning controller used
+// by DialAutoTune/ListenAutoTune.
+func SetAutoTune(v bool) {
+	autoTuneLock.Lock()
+	defer autoTuneLock.Unlock()
+	autoTuneEnabled = v
+}
+
+func isAutoTuneEnabled() bool {
+	autoTuneLock.Lock()
+	defer autoTuneLock.Unlock()
+	return autoTuneEnabled
+}
+
+// TuneStats is a point-in-time snapshot of what the AutoTune controller has
+// observed and decided for a given session. There is no MinRTT field:
+// kcp-go's *UDPSession exposes no accessor for its internal smoothed RTT,
+// so the probe-rtt phase only drains the window and does not try to sample
+// one.
+type TuneStats struct {
+	LossRate float64
+	// DataShards/ParityShards is the FEC ratio the controller would like to
+	// run at. kcp-go does not support changing FEC shard counts on a live
+	// session, so WantParityShards only takes effect on the next
+	// Dial/ListenAutoTune call made with it.
+	DataShards       int
+	WantParityShards int
+	Probing          bool // true while in the probe-bw phase
+}
+
+// dupDetector estimates a per-source retransmit rate by recognizing when an
+// outgoing payload repeats one seen in the last dupDetectorWindow writes:
+// KCP retransmits a lost segment by writing its bytes again, so a duplicate
+// hash within that short window is a reasonable proxy for a loss event on
+// this specific source, without reading kcp.DefaultSnmp (which aggregates
+// every concurrent session in the process, not just this one).
+type dupDetector struct {
+	mu     sync.Mutex
+	recent [dupDetectorWindow]uint32
+	idx    int
+	total  uint64
+	dup    uint64
+}
+
+func (d *dupDetector) observe(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	h := fnv.New32a()
+	h.Write(p)
+	sum := h.Sum32()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.recent {
+		if r == sum {
+			d.dup++
+			d.total++
+			return
+		}
+	}
+	d.recent[d.idx%len(d.recent)] = sum
+	d.idx++
+	d.total++
+}
+
+// snapshotAndReset returns the observed duplicate ratio since the last call
+// and clears the counters, so tuner.sample gets a per-window rate rather
+// than a rate diluted by the source's entire lifetime.
+func (d *dupDetector) snapshotAndReset() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var rate float64
+	if d.total > 0 {
+		rate = float64(d.dup) / float64(d.total)
+	}
+	d.total, d.dup = 0, 0
+	return rate
+}
+
+// tunerLossSource is whatever a tuner samples its per-window loss rate
+// from: tunerConn on the dial side, tunerPeerLossSource on the listen side.
+type tunerLossSource interface {
+	sampleLossRate() float64
+}
+
+// tunerConn wraps a dialed session's own PacketConn to feed a dupDetector,
+// giving DialAutoTune a loss signal scoped to this session alone.
+type tunerConn struct {
+	net.PacketConn
+	dd dupDetector
+}
+
+func newTunerConn(pc net.PacketConn) *tunerConn {
+	return &tunerConn{PacketConn: pc}
+}
+
+func (t *tunerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	t.dd.observe(p)
+	return t.PacketConn.WriteTo(p, addr)
+}
+
+func (t *tunerConn) sampleLossRate() float64 {
+	return t.dd.snapshotAndReset()
+}
+
+// tunerListenPacketConn wraps a listener's shared raw PacketConn, keeping
+// one dupDetector per remote address so ListenAutoTune's accepted sessions
+// each get a loss signal scoped to their own peer despite sharing one
+// socket.
+type tunerListenPacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	dets map[string]*dupDetector
+}
+
+func newTunerListenPacketConn(pc net.PacketConn) *tunerListenPacketConn {
+	return &tunerListenPacketConn{PacketConn: pc, dets: make(map[string]*dupDetector)}
+}
+
+func (t *tunerListenPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	t.detector(addr.String()).observe(p)
+	return t.PacketConn.WriteTo(p, addr)
+}
+
+func (t *tunerListenPacketConn) detector(key string) *dupDetector {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.dets[key]
+	if !ok {
+		d = &dupDetector{}
+		t.dets[key] = d
+	}
+	return d
+}
+
+func (t *tunerListenPacketConn) snapshotLossRate(key string) float64 {
+	t.mu.Lock()
+	d, ok := t.dets[key]
+	t.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return d.snapshotAndReset()
+}
+
+// tunerPeerLossSource adapts a tunerListenPacketConn's per-addr dupDetector
+// to tunerLossSource for one accepted session.
+type tunerPeerLossSource struct {
+	lpc *tunerListenPacketConn
+	key string
+}
+
+func (s *tunerPeerLossSource) sampleLossRate() float64 {
+	return s.lpc.snapshotLossRate(s.key)
+}
+
+// tuner drives the adaptive congestion/FEC controller for a single session.
+// It alternates, once per autoTuneSampleWindow, a probe-bw phase (window set
+// to autoTuneProbeWnd) with a probe-rtt phase (window drained to
+// autoTuneDrainWnd). Throughput is not measured, so a probe-bw phase always
+// lasts one sample window rather than until throughput plateaus. It samples its
+// loss field from the session's own loss source between ticks (see
+// tunerLossSource), and separately recommends raising/lowering
+// parityShards based on recent loss.
+type tuner struct {
+	sess *kcp.UDPSession
+	loss tunerLossSource
+
+	mu           sync.Mutex
+	dataShards   int
+	parityShards int
+	lastLoss     float64
+	quietRounds  int
+	probing      int32 // atomic bool: 1 while probe-bw is in progress
+
+	stop chan struct{}
+}
+
+func newTuner(sess *kcp.UDPSession, dataShards, parityShards int, loss tunerLossSource) *tuner {
+	t := &tuner{
+		sess:         sess,
+		loss:         loss,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		stop:         make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tuner) run() {
+	ticker := time.NewTicker(autoTuneSampleWindow)
+	defer ticker.Stop()
+	probeBW := true
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			atomic.StoreInt32(&t.probing, boolToInt32(probeBW))
+			t.sample(probeBW)
+			probeBW = !probeBW
+		}
+	}
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sample reads this session's own loss source and adjusts nodelay/window
+// parameters, plus the recommended FEC parity ratio, accordingly.
+func (t *tuner) sample(probeBW bool) {
+	var loss float64
+	if t.loss != nil {
+		loss = t.loss.sampleLossRate()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastLoss = loss
+
+	if loss > autoTuneLossThreshold {
+		t.quietRounds = 0
+		if t.parityShards < autoTuneMaxParity {
+			t.parityShards++
+		}
+	} else {
+		t.quietRounds++
+		if t.quietRounds >= autoTuneQuietRounds && t.parityShards > autoTuneMinParity {
+			t.parityShards--
+			t.quietRounds = 0
+		}
+	}
+
+	if probeBW {
+		// probe-bw: open the window to autoTuneProbeWnd, whatever the loss.
+		t.sess.SetWindowSize(autoTuneProbeWnd, autoTuneProbeWnd)
+		t.sess.SetNoDelay(1, 20, 2, 1)
+	} else {
+		// probe-rtt: briefly drain the window so the next probe-bw round
+		// starts from an uncongested baseline.
+		t.sess.SetWindowSize(autoTuneDrainWnd, autoTuneDrainWnd)
+		t.sess.SetNoDelay(1, 40, 1, 1)
+	}
+}
+
+func (t *tuner) Stats() TuneStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TuneStats{
+		LossRate:         t.lastLoss,
+		DataShards:       t.dataShards,
+		WantParityShards: t.parityShards,
+		Probing:          atomic.LoadInt32(&t.probing) == 1,
+	}
+}
+
+func (t *tuner) Close() {
+	close(t.stop)
+}
+
+var (
+	tunersLock sync.Mutex
+	tuners     = make(map[*kcp.UDPSession]*tuner)
+)
+
+func registerTuner(sess *kcp.UDPSession, dataShards, parityShards int, loss tunerLossSource) {
+	t := newTuner(sess, dataShards, parityShards, loss)
+	tunersLock.Lock()
+	tuners[sess] = t
+	tunersLock.Unlock()
+}
+
+// unregisterTuner stops sess's tuner goroutine and drops it from the
+// registry, if it has one. Called from CloseSession (metrics.go) so
+// AutoTune sessions don't leak a ticker goroutine per session the way the
+// earlier registerTuner-with-no-unregister did.
+func unregisterTuner(sess *kcp.UDPSession) {
+	tunersLock.Lock()
+	t, ok := tuners[sess]
+	delete(tuners, sess)
+	tunersLock.Unlock()
+	if ok {
+		t.Close()
+	}
+}
+
+// GetTuneStats returns the current AutoTune snapshot for sess, or the zero
+// value if sess was not dialed/listened with AutoTune enabled.
+func GetTuneStats(sess *kcp.UDPSession) TuneStats {
+	tunersLock.Lock()
+	t, ok := tuners[sess]
+	tunersLock.Unlock()
+	if !ok {
+		return TuneStats{}
+	}
+	return t.Stats()
+}
+
+// DialAutoTune is DialWithOptions with the BBR-style AutoTune controller
+// attached; it has no effect unless SetAutoTune(true) was called. Callers
+// that enable it should close the returned session with CloseSession
+// instead of sess.Close(), or the tuner's ticker goroutine leaks.
+func DialAutoTune(raddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.UDPSession, error) {
+	if !isAutoTuneEnabled() {
+		return DialWithOptions(raddr, block, dataShards, parityShards)
+	}
+	err := checkAddr(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checkAddr")
+	}
+	conn, err := raw.DialRAW(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.DialRAW")
+	}
+	mss := conn.GetMSS()
+	if probed, ok := maybeProbePMTUOnConn(conn); ok {
+		mss = probed
+	} else {
+		mssCacheLock.Lock()
+		if cached, ok := mssCache[pmtuKey(raddr)]; ok {
+			mss = cached
+		}
+		mssCacheLock.Unlock()
+		putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), mss)
+	}
+	wrapped, err := wrapDialPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapDialPacketConn")
+	}
+	tc := newTunerConn(wrapped)
+	meter := newMeteringConn(tc)
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerSessionMetricsWithConn(sess, meter, mss)
+	registerTuner(sess, dataShards, parityShards, tc)
+	return sess, nil
+}
+
+// ListenAutoTune is ListenWithOptions with the BBR-style AutoTune controller
+// attached to every accepted session; it has no effect unless
+// SetAutoTune(true) was called. Callers that enable it should close
+// accepted sessions with CloseSession instead of sess.Close().
+func ListenAutoTune(laddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.Listener, error) {
+	if !isAutoTuneEnabled() {
+		return ListenWithOptions(laddr, block, dataShards, parityShards)
+	}
+	err := checkAddr(laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checkAddr")
+	}
+	conn, err := raw.ListenRAW(laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenRAW")
+	}
+	putListenerByAddr(conn.LocalAddr(), conn)
+	wrapped, err := wrapListenPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapListenPacketConn")
+	}
+	tlc := newTunerListenPacketConn(wrapped)
+	meter := newMetricsListenPacketConn(tlc)
+	lis, err := kcp.ServeConn(block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerListenerMetricsWithConn(lis, meter)
+	go autoTuneAcceptLoop(lis, dataShards, parityShards, tlc)
+	return lis, nil
+}
+
+func autoTuneAcceptLoop(lis *kcp.Listener, dataShards, parityShards int, tlc *tunerListenPacketConn) {
+	for {
+		sess, err := lis.AcceptKCP()
+		if err != nil {
+			return
+		}
+		key := sess.RemoteAddr().String()
+		registerTuner(sess, dataShards, parityShards, &tunerPeerLossSource{lpc: tlc, key: key})
+	}
+}
@@ -0,0 +1,313 @@
+package kcpraw
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+var (
+	metricsEnabled bool
+	metricsLock    sync.Mutex
+)
+
+// SetMetricsEnabled turns session/listener registration with the global
+// Collector on or off for subsequent Dial/ListenWithOptions calls.
+func SetMetricsEnabled(v bool) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsEnabled = v
+}
+
+func isMetricsEnabled() bool {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	return metricsEnabled
+}
+
+// sessionStats holds the counters tracked for a single registered session.
+// bytesIn/bytesOut are only live when the session was registered through
+// registerSessionMetricsWithConn's meteringConn path (DialWithOptions,
+// DialMulWithOptions, DialAutoTune); sessions registered through
+// registerSessionMetrics (e.g. DialWithSTUN, DialThroughProxy)
+// report 0 for those rather than a fabricated value. There is no per-session
+// RTT metric: kcp-go's *UDPSession exposes no accessor for its internal
+// smoothed RTT, so one isn't reported here rather than faked.
+type sessionStats struct {
+	meter *meteringConn // nil if this session wasn't registered with metering
+	mss   uint64
+}
+
+// listenerStats holds the counters tracked for a single registered listener.
+// accepts/bytesIn/bytesOut come from metricsListenPacketConn, which detects
+// each new remote address as an accept and meters the raw bytes flowing
+// through the shared PacketConn.
+type listenerStats struct {
+	meter *metricsListenPacketConn // nil if registered without metering
+}
+
+// collector aggregates per-session and per-listener counters for export in
+// Prometheus text format. The zero value is ready to use; the package-level
+// Collector is what DialWithOptions/ListenWithOptions register against.
+type collector struct {
+	mu        sync.Mutex
+	sessions  map[*kcp.UDPSession]*sessionStats
+	listeners map[*kcp.Listener]*listenerStats
+}
+
+// Collector is the global metrics registry populated by DialWithOptions,
+// DialMulWithOptions, ListenWithOptions and ListenMulWithOptions whenever
+// SetMetricsEnabled(true) is in effect.
+var Collector = newCollector()
+
+func newCollector() *collector {
+	return &collector{
+		sessions:  make(map[*kcp.UDPSession]*sessionStats),
+		listeners: make(map[*kcp.Listener]*listenerStats),
+	}
+}
+
+// RegisterSession starts tracking sess. meter may be nil when the caller has
+// no metered conn to report bytesIn/bytesOut from.
+func (c *collector) RegisterSession(sess *kcp.UDPSession, meter *meteringConn, mss int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[sess] = &sessionStats{meter: meter, mss: uint64(mss)}
+}
+
+// UnregisterSession stops tracking sess, e.g. once it is closed. Prefer
+// CloseSession, which does this automatically.
+func (c *collector) UnregisterSession(sess *kcp.UDPSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, sess)
+}
+
+// RegisterListener starts tracking lis. meter may be nil when the caller
+// has no metered PacketConn to report accepts/bytes from.
+func (c *collector) RegisterListener(lis *kcp.Listener, meter *metricsListenPacketConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners[lis] = &listenerStats{meter: meter}
+}
+
+// UnregisterListener stops tracking lis. Prefer CloseListener, which does
+// this automatically.
+func (c *collector) UnregisterListener(lis *kcp.Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.listeners, lis)
+}
+
+func (c *collector) activeSessions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+// WriteProm renders all tracked counters in Prometheus text exposition
+// format. Retransmit/loss counters are process-global in kcp-go (there is
+// no public per-session breakdown), so they are reported once rather than
+// attributed to an arbitrary session.
+func (c *collector) WriteProm(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snmp := kcp.DefaultSnmp.Copy()
+	fmt.Fprintf(w, "# HELP kcpraw_global_retrans_segs_total KCP retransmitted segments, process-wide\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_global_retrans_segs_total counter\n")
+	fmt.Fprintf(w, "kcpraw_global_retrans_segs_total %d\n", snmp.RetransSegs)
+	fmt.Fprintf(w, "# HELP kcpraw_global_lost_segs_total KCP lost segments, process-wide\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_global_lost_segs_total counter\n")
+	fmt.Fprintf(w, "kcpraw_global_lost_segs_total %d\n", snmp.LostSegs)
+
+	fmt.Fprintf(w, "# HELP kcpraw_active_sessions Number of currently registered KCP sessions\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_active_sessions gauge\n")
+	fmt.Fprintf(w, "kcpraw_active_sessions %d\n", len(c.sessions))
+
+	fmt.Fprintf(w, "# HELP kcpraw_session_bytes_in_total Bytes received per session (0 if registered without a metered conn)\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_session_bytes_in_total counter\n")
+	fmt.Fprintf(w, "# HELP kcpraw_session_bytes_out_total Bytes sent per session (0 if registered without a metered conn)\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_session_bytes_out_total counter\n")
+	fmt.Fprintf(w, "# HELP kcpraw_session_mss_bytes MSS recorded for the session at dial time\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_session_mss_bytes gauge\n")
+
+	i := 0
+	for _, s := range c.sessions {
+		var in, out uint64
+		if s.meter != nil {
+			in, out = s.meter.BytesIn(), s.meter.BytesOut()
+		}
+		fmt.Fprintf(w, "kcpraw_session_bytes_in_total{session=\"%d\"} %d\n", i, in)
+		fmt.Fprintf(w, "kcpraw_session_bytes_out_total{session=\"%d\"} %d\n", i, out)
+		fmt.Fprintf(w, "kcpraw_session_mss_bytes{session=\"%d\"} %d\n", i, atomic.LoadUint64(&s.mss))
+		i++
+	}
+
+	fmt.Fprintf(w, "# HELP kcpraw_listener_accepts_total New remote addresses observed per listener\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_listener_accepts_total counter\n")
+	fmt.Fprintf(w, "# HELP kcpraw_listener_bytes_in_total Bytes received per listener\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_listener_bytes_in_total counter\n")
+	fmt.Fprintf(w, "# HELP kcpraw_listener_bytes_out_total Bytes sent per listener\n")
+	fmt.Fprintf(w, "# TYPE kcpraw_listener_bytes_out_total counter\n")
+	i = 0
+	for _, s := range c.listeners {
+		var accepts, in, out uint64
+		if s.meter != nil {
+			accepts, in, out = s.meter.Accepts(), s.meter.BytesIn(), s.meter.BytesOut()
+		}
+		fmt.Fprintf(w, "kcpraw_listener_accepts_total{listener=\"%d\"} %d\n", i, accepts)
+		fmt.Fprintf(w, "kcpraw_listener_bytes_in_total{listener=\"%d\"} %d\n", i, in)
+		fmt.Fprintf(w, "kcpraw_listener_bytes_out_total{listener=\"%d\"} %d\n", i, out)
+		i++
+	}
+	return nil
+}
+
+// registerSessionMetrics registers sess with the global Collector (without a
+// metered conn) if SetMetricsEnabled(true) is in effect. Used by entry
+// points that don't construct their own meteringConn, e.g. DialWithSTUN and
+// DialThroughProxy.
+func registerSessionMetrics(sess *kcp.UDPSession) {
+	if isMetricsEnabled() {
+		Collector.RegisterSession(sess, nil, 0)
+	}
+}
+
+// registerSessionMetricsWithConn registers sess along with the meteringConn
+// KCP is reading/writing through and the MSS observed at dial time, so
+// WriteProm can report real bytesIn/bytesOut/mss for it.
+func registerSessionMetricsWithConn(sess *kcp.UDPSession, meter *meteringConn, mss int) {
+	if isMetricsEnabled() {
+		Collector.RegisterSession(sess, meter, mss)
+	}
+}
+
+// registerListenerMetrics registers lis with the global Collector (without a
+// metered PacketConn) if SetMetricsEnabled(true) is in effect.
+func registerListenerMetrics(lis *kcp.Listener) {
+	if isMetricsEnabled() {
+		Collector.RegisterListener(lis, nil)
+	}
+}
+
+// registerListenerMetricsWithConn registers lis along with the
+// metricsListenPacketConn wrapping its shared raw socket, so WriteProm can
+// report real accepts/bytesIn/bytesOut for it.
+func registerListenerMetricsWithConn(lis *kcp.Listener, meter *metricsListenPacketConn) {
+	if isMetricsEnabled() {
+		Collector.RegisterListener(lis, meter)
+	}
+}
+
+// CloseSession closes sess and unregisters it from the Collector and, if it
+// was registered with DialAutoTune/ListenAutoTune, from the AutoTune
+// registry too — both otherwise have no way to learn about sess.Close() on
+// their own. Callers that enable metrics and/or AutoTune should use this
+// instead of calling sess.Close() directly.
+func CloseSession(sess *kcp.UDPSession) error {
+	err := sess.Close()
+	Collector.UnregisterSession(sess)
+	unregisterTuner(sess)
+	return err
+}
+
+// CloseListener closes lis and unregisters it from the Collector. Callers
+// that enable metrics should use this instead of calling lis.Close()
+// directly.
+func CloseListener(lis *kcp.Listener) error {
+	err := lis.Close()
+	Collector.UnregisterListener(lis)
+	return err
+}
+
+// meteringConn wraps a net.PacketConn to count bytes read/written through
+// it, feeding a registered session's bytesIn/bytesOut. This is the dial-side
+// counterpart of metricsListenPacketConn; it wraps net.PacketConn rather
+// than net.Conn because that's what kcp.NewConn itself requires (see
+// wrapDialPacketConn).
+type meteringConn struct {
+	net.PacketConn
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func newMeteringConn(pc net.PacketConn) *meteringConn {
+	return &meteringConn{PacketConn: pc}
+}
+
+func (m *meteringConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := m.PacketConn.ReadFrom(p)
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+	return n, addr, err
+}
+
+func (m *meteringConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := m.PacketConn.WriteTo(p, addr)
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+	return n, err
+}
+
+func (m *meteringConn) BytesIn() uint64  { return atomic.LoadUint64(&m.bytesIn) }
+func (m *meteringConn) BytesOut() uint64 { return atomic.LoadUint64(&m.bytesOut) }
+
+// metricsListenPacketConn wraps the shared net.PacketConn behind a listener
+// to count total bytes in/out and to count each newly-seen remote address
+// as one accept — the closest real proxy for "sessions accepted" available
+// at the PacketConn level, since kcp.Listener itself gives us no accept
+// hook to observe the user's own AcceptKCP calls.
+type metricsListenPacketConn struct {
+	net.PacketConn
+	bytesIn  uint64
+	bytesOut uint64
+	accepts  uint64
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newMetricsListenPacketConn(pc net.PacketConn) *metricsListenPacketConn {
+	return &metricsListenPacketConn{PacketConn: pc, seen: make(map[string]struct{})}
+}
+
+func (m *metricsListenPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := m.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+	if addr != nil {
+		key := addr.String()
+		m.mu.Lock()
+		if _, ok := m.seen[key]; !ok {
+			m.seen[key] = struct{}{}
+			atomic.AddUint64(&m.accepts, 1)
+		}
+		m.mu.Unlock()
+	}
+	return n, addr, nil
+}
+
+func (m *metricsListenPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := m.PacketConn.WriteTo(p, addr)
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+	return n, err
+}
+
+func (m *metricsListenPacketConn) BytesIn() uint64  { return atomic.LoadUint64(&m.bytesIn) }
+func (m *metricsListenPacketConn) BytesOut() uint64 { return atomic.LoadUint64(&m.bytesOut) }
+func (m *metricsListenPacketConn) Accepts() uint64  { return atomic.LoadUint64(&m.accepts) }
+
+// MetricsHandler returns an http.Handler that exposes the global Collector
+// in Prometheus text format, suitable for mounting at e.g. "/metrics".
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Collector.WriteProm(w)
+	})
+}
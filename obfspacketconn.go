@@ -0,0 +1,332 @@
+package kcpraw
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// obfsHandshakeTimeout bounds how long a new peer's Obfuscator.WrapListen
+	// handshake may run before it is abandoned. Without this, a source
+	// address that only ever trickles a few bytes (or none at all) would
+	// pin a goroutine blocked in WrapListen forever.
+	obfsHandshakeTimeout = 15 * time.Second
+
+	// obfsIdleTimeout evicts an established peer that has gone quiet for
+	// this long, so a spoofed or abandoned source address doesn't keep its
+	// map entry and pump goroutine alive indefinitely.
+	obfsIdleTimeout = 5 * time.Minute
+
+	// obfsReapInterval is how often the idle sweep in reap runs.
+	obfsReapInterval = 1 * time.Minute
+)
+
+var errObfsHandshakeTimeout = errors.New("obfsPacketConn: obfuscator handshake timed out")
+
+// obfsPacketConn adapts a single multiplexed net.PacketConn (what
+// raw.ListenRAW / mulcon.Listen hand to kcp.ServeConn) so that the selected
+// Obfuscator's WrapListen still runs per remote peer, even though KCP only
+// ever sees one shared socket. Each new remote address gets its own
+// peerConn (a net.Conn view onto that one address) which is fed through
+// obfuscator.WrapListen exactly once; everything read back out of the
+// wrapped conn is what ReadFrom hands to KCP, and everything KCP writes is
+// sent back out through the same wrapped conn so TLS-mimic/WS framing is
+// symmetric.
+type obfsPacketConn struct {
+	pc         net.PacketConn
+	obfuscator Obfuscator
+
+	mu    sync.Mutex
+	peers map[string]*obfsPeer
+	out   chan obfsPacket
+	done  chan struct{}
+}
+
+type obfsPeer struct {
+	raw     *peerConn
+	wrapped net.Conn
+	ready   chan struct{}
+	err     error
+
+	lastActive int64 // unix nano, updated on every inbound packet; atomic
+}
+
+type obfsPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newObfsPacketConn(pc net.PacketConn, obfuscator Obfuscator) *obfsPacketConn {
+	o := &obfsPacketConn{
+		pc:         pc,
+		obfuscator: obfuscator,
+		peers:      make(map[string]*obfsPeer),
+		out:        make(chan obfsPacket, 128),
+		done:       make(chan struct{}),
+	}
+	go o.pump()
+	go o.reap()
+	return o
+}
+
+// pump continuously demultiplexes raw datagrams by remote address and
+// forwards each to that peer's raw conn for WrapListen to consume.
+func (o *obfsPacketConn) pump() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := o.pc.ReadFrom(buf)
+		if err != nil {
+			o.closeOut()
+			return
+		}
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		peer := o.getOrCreatePeer(addr)
+		atomic.StoreInt64(&peer.lastActive, time.Now().UnixNano())
+		// peer.raw.deliver drops rather than blocks the shared demux loop
+		// when that peer's WrapListen goroutine is stalled or already gone.
+		peer.raw.deliver(pkt)
+	}
+}
+
+// reap periodically evicts peers that have gone quiet for obfsIdleTimeout,
+// closing their raw conn so the stuck handshakeAndPump goroutine (if any)
+// unblocks and the map entry is freed.
+func (o *obfsPacketConn) reap() {
+	ticker := time.NewTicker(obfsReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-obfsIdleTimeout).UnixNano()
+			o.mu.Lock()
+			stale := make([]*peerConn, 0)
+			for _, peer := range o.peers {
+				if atomic.LoadInt64(&peer.lastActive) < cutoff {
+					stale = append(stale, peer.raw)
+				}
+			}
+			o.mu.Unlock()
+			for _, raw := range stale {
+				raw.Close()
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *obfsPacketConn) closeOut() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+	}
+}
+
+func (o *obfsPacketConn) getOrCreatePeer(addr net.Addr) *obfsPeer {
+	key := addr.String()
+	o.mu.Lock()
+	peer, ok := o.peers[key]
+	if ok {
+		o.mu.Unlock()
+		return peer
+	}
+	raw := &peerConn{owner: o, raddr: addr, in: make(chan []byte, 16)}
+	peer = &obfsPeer{raw: raw, ready: make(chan struct{}), lastActive: time.Now().UnixNano()}
+	o.peers[key] = peer
+	o.mu.Unlock()
+
+	go o.handshakeAndPump(peer)
+	return peer
+}
+
+// handshakeAndPump runs the peer's Obfuscator.WrapListen handshake under
+// obfsHandshakeTimeout, then pumps unwrapped payloads into o.out until the
+// wrapped conn errors or this peer is evicted. peer.raw is always closed on
+// return, which removes it from o.peers and unblocks any goroutine still
+// stuck reading from it.
+func (o *obfsPacketConn) handshakeAndPump(peer *obfsPeer) {
+	defer peer.raw.Close()
+
+	type handshakeResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan handshakeResult, 1)
+	go func() {
+		wrapped, err := o.obfuscator.WrapListen(peer.raw)
+		done <- handshakeResult{wrapped, err}
+	}()
+
+	select {
+	case r := <-done:
+		peer.wrapped, peer.err = r.conn, r.err
+	case <-time.After(obfsHandshakeTimeout):
+		peer.err = errObfsHandshakeTimeout
+	case <-o.done:
+		peer.err = io.ErrClosedPipe
+	}
+	close(peer.ready)
+	if peer.err != nil {
+		return
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := peer.wrapped.Read(buf)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&peer.lastActive, time.Now().UnixNano())
+		data := append([]byte(nil), buf[:n]...)
+		select {
+		case o.out <- obfsPacket{data: data, addr: peer.raw.raddr}:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn, handing back payloads that have
+// already been unwrapped by the peer's Obfuscator.
+func (o *obfsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt, ok := <-o.out:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		n := copy(p, pkt.data)
+		return n, pkt.addr, nil
+	case <-o.done:
+		return 0, nil, io.EOF
+	}
+}
+
+// WriteTo implements net.PacketConn, routing through the peer's wrapped
+// conn once its Obfuscator handshake has completed so replies get the same
+// framing (e.g. masked WS frames) as the inbound side, and falling back to
+// a raw write while the handshake is still in flight or for a peer we have
+// not heard from yet.
+func (o *obfsPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	o.mu.Lock()
+	peer, ok := o.peers[addr.String()]
+	o.mu.Unlock()
+	if !ok {
+		return o.pc.WriteTo(p, addr)
+	}
+	select {
+	case <-peer.ready:
+	default:
+		return o.pc.WriteTo(p, addr)
+	}
+	if peer.err != nil || peer.wrapped == nil {
+		return o.pc.WriteTo(p, addr)
+	}
+	return peer.wrapped.Write(p)
+}
+
+func (o *obfsPacketConn) Close() error {
+	o.closeOut()
+	return o.pc.Close()
+}
+
+func (o *obfsPacketConn) LocalAddr() net.Addr                { return o.pc.LocalAddr() }
+func (o *obfsPacketConn) SetDeadline(t time.Time) error      { return o.pc.SetDeadline(t) }
+func (o *obfsPacketConn) SetReadDeadline(t time.Time) error  { return o.pc.SetReadDeadline(t) }
+func (o *obfsPacketConn) SetWriteDeadline(t time.Time) error { return o.pc.SetWriteDeadline(t) }
+
+// peerConn is a net.Conn view of one remote address on top of the shared
+// obfsPacketConn, letting Obfuscator.WrapListen (which expects a stream
+// conn) run per peer despite KCP only ever seeing one multiplexed socket.
+type peerConn struct {
+	owner *obfsPacketConn
+	raddr net.Addr
+	in    chan []byte
+	buf   []byte
+
+	closeMu sync.Mutex
+	closed  bool
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		chunk, ok := <-c.in
+		if !ok {
+			return 0, io.EOF
+		}
+		c.buf = chunk
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *peerConn) Write(p []byte) (int, error) {
+	return c.owner.pc.WriteTo(p, c.raddr)
+}
+
+// deliver hands a demultiplexed packet to this peer's Read loop, dropping it
+// instead of blocking or panicking if the peer has since been evicted or its
+// buffer is full.
+func (c *peerConn) deliver(p []byte) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.in <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *peerConn) Close() error {
+	c.owner.mu.Lock()
+	delete(c.owner.peers, c.raddr.String())
+	c.owner.mu.Unlock()
+
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.in)
+	}
+	return nil
+}
+
+func (c *peerConn) LocalAddr() net.Addr  { return c.owner.pc.LocalAddr() }
+func (c *peerConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *peerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *peerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *peerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// wrapListenPacketConn wraps pc with the currently selected Obfuscator, via
+// obfsPacketConn, unless that Obfuscator is the no-op HTTP backend (which
+// already does its obfuscation below KCP, inside raw itself) — in that case
+// pc is returned unchanged to avoid the per-peer goroutine overhead for the
+// common default case.
+func wrapListenPacketConn(pc net.PacketConn) (net.PacketConn, error) {
+	o, err := getObfuscator()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := o.(*httpObfuscator); ok {
+		return pc, nil
+	}
+	return newObfsPacketConn(pc, o), nil
+}
@@ -0,0 +1,292 @@
+package kcpraw
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMinMTU is the lower bound used by ProbePMTU's binary search.
+	DefaultMinMTU = 576
+	// DefaultMaxMTU is the upper bound used by ProbePMTU's binary search.
+	DefaultMaxMTU = 1500
+
+	pmtuProbeTimeout = 500 * time.Millisecond
+)
+
+// ProbeOptions controls ProbePMTU's search range and how often a long-lived
+// session should be re-probed.
+type ProbeOptions struct {
+	MinMTU int
+	MaxMTU int
+	// RefreshInterval, if non-zero, causes StartPMTURefresh to re-probe on
+	// this cadence instead of only on demand.
+	RefreshInterval time.Duration
+}
+
+func (o ProbeOptions) withDefaults() ProbeOptions {
+	if o.MinMTU <= 0 {
+		o.MinMTU = DefaultMinMTU
+	}
+	if o.MaxMTU <= 0 {
+		o.MaxMTU = DefaultMaxMTU
+	}
+	return o
+}
+
+var (
+	pmtuProbingEnabled bool
+	pmtuProbingLock    sync.Mutex
+)
+
+// SetPMTUProbing makes DialWithOptions and DialAutoTune run ProbePMTU's
+// binary search (with default ProbeOptions) from the dialed connection's own
+// local port, right after the raw dial and before handing the connection to
+// kcp.NewConn (see maybeProbePMTUOnConn).
+func SetPMTUProbing(v bool) {
+	pmtuProbingLock.Lock()
+	defer pmtuProbingLock.Unlock()
+	pmtuProbingEnabled = v
+}
+
+func isPMTUProbingEnabled() bool {
+	pmtuProbingLock.Lock()
+	defer pmtuProbingLock.Unlock()
+	return pmtuProbingEnabled
+}
+
+// pmtuKey namespaces the by-destination PMTU cache entries within the
+// shared mssCache map, separate from the per-(laddr,raddr) entries that
+// putMSSByAddr writes.
+func pmtuKey(raddr string) string {
+	return "pmtu:" + raddr
+}
+
+// ProbePMTU discovers the path MTU to raddr with a binary search between
+// opts.MinMTU and opts.MaxMTU: it opens a UDP socket to raddr, enables
+// IP_MTU_DISCOVER (Linux's equivalent of setting the DF bit), and sends
+// increasingly large probe datagrams, shrinking the search window whenever
+// the kernel reports EMSGSIZE or the probe socket never becomes writable
+// for that size within pmtuProbeTimeout. The discovered MSS is cached under
+// raddr for subsequent DialWithOptions calls to pick up.
+func ProbePMTU(raddr string, opts ProbeOptions) (int, error) {
+	opts = opts.withDefaults()
+
+	udpaddr, err := net.ResolveUDPAddr("udp4", raddr)
+	if err != nil {
+		return 0, errors.Wrap(err, "ProbePMTU ResolveUDPAddr")
+	}
+	conn, err := net.DialUDP("udp4", nil, udpaddr)
+	if err != nil {
+		return 0, errors.Wrap(err, "ProbePMTU DialUDP")
+	}
+	defer conn.Close()
+
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "ProbePMTU SyscallConn")
+	}
+	var sockErr error
+	err = rawconn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "ProbePMTU Control")
+	}
+	if sockErr != nil {
+		return 0, errors.Wrap(sockErr, "ProbePMTU IP_MTU_DISCOVER")
+	}
+
+	lo, hi := opts.MinMTU, opts.MaxMTU
+	best := lo
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if probeMTUSize(conn, mid) {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), best)
+	mssCacheLock.Lock()
+	mssCache[pmtuKey(raddr)] = best
+	mssCacheLock.Unlock()
+	return best, nil
+}
+
+// probeMTUSize sends a single size-byte UDP probe with DF set; it returns
+// false if the kernel reports the packet was too large for the path.
+func probeMTUSize(conn *net.UDPConn, size int) bool {
+	payload := make([]byte, size)
+	conn.SetWriteDeadline(time.Now().Add(pmtuProbeTimeout))
+	_, err := conn.Write(payload)
+	conn.SetWriteDeadline(time.Time{})
+	if err == nil {
+		return true
+	}
+	if errno, ok := underlyingErrno(err); ok && errno == syscall.EMSGSIZE {
+		return false
+	}
+	// any other error (e.g. timeout) is treated conservatively as "too big"
+	return false
+}
+
+// probeMTUSizeTo is probeMTUSize for an unconnected PacketConn bound to a
+// specific local port (see reusePortListenUDP), sending explicitly to
+// raddr since the socket itself is not connect()ed to it.
+func probeMTUSizeTo(conn *net.UDPConn, raddr *net.UDPAddr, size int) bool {
+	payload := make([]byte, size)
+	conn.SetWriteDeadline(time.Now().Add(pmtuProbeTimeout))
+	_, err := conn.WriteToUDP(payload, raddr)
+	conn.SetWriteDeadline(time.Time{})
+	if err == nil {
+		return true
+	}
+	if errno, ok := underlyingErrno(err); ok && errno == syscall.EMSGSIZE {
+		return false
+	}
+	// any other error (e.g. timeout) is treated conservatively as "too big"
+	return false
+}
+
+// probePMTUOnConn runs the same binary search as ProbePMTU, but against a
+// probe socket bound to the exact local port conn is already using (via
+// reusePortListenUDP) instead of a throwaway socket on its own ephemeral
+// port — the discovered MTU is only meaningful for the path conn's own
+// packets actually take.
+func probePMTUOnConn(conn net.Conn, opts ProbeOptions) (int, error) {
+	opts = opts.withDefaults()
+
+	raddr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("probePMTUOnConn: conn.RemoteAddr() is not a *net.UDPAddr")
+	}
+	probe, err := reusePortListenUDP(conn.LocalAddr())
+	if err != nil {
+		return 0, errors.Wrap(err, "probePMTUOnConn reusePortListenUDP")
+	}
+	defer probe.Close()
+
+	rawconn, err := probe.SyscallConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "probePMTUOnConn SyscallConn")
+	}
+	var sockErr error
+	err = rawconn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "probePMTUOnConn Control")
+	}
+	if sockErr != nil {
+		return 0, errors.Wrap(sockErr, "probePMTUOnConn IP_MTU_DISCOVER")
+	}
+
+	lo, hi := opts.MinMTU, opts.MaxMTU
+	best := lo
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if probeMTUSizeTo(probe, raddr, mid) {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best, nil
+}
+
+func underlyingErrno(err error) (syscall.Errno, bool) {
+	type causer interface{ Cause() error }
+	for err != nil {
+		if op, ok := err.(*net.OpError); ok {
+			err = op.Err
+			continue
+		}
+		if se, ok := err.(*syscall.Errno); ok {
+			return *se, true
+		}
+		if errno, ok := err.(syscall.Errno); ok {
+			return errno, true
+		}
+		if c, ok := err.(causer); ok {
+			err = c.Cause()
+			continue
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// pmtuRefreshers tracks the background refresh goroutines started by
+// StartPMTURefresh, keyed by raddr, so a second call replaces rather than
+// leaks the previous one.
+var (
+	pmtuRefreshers     = make(map[string]chan struct{})
+	pmtuRefreshersLock sync.Mutex
+)
+
+// StartPMTURefresh re-probes raddr on opts.RefreshInterval, e.g. after N
+// consecutive fast retransmits have made the caller suspect a path change.
+// Calling it again for the same raddr replaces the previous refresher.
+func StartPMTURefresh(raddr string, opts ProbeOptions) {
+	if opts.RefreshInterval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+
+	pmtuRefreshersLock.Lock()
+	if old, ok := pmtuRefreshers[raddr]; ok {
+		close(old)
+	}
+	pmtuRefreshers[raddr] = stop
+	pmtuRefreshersLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(opts.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ProbePMTU(raddr, opts)
+			}
+		}
+	}()
+}
+
+// StopPMTURefresh stops a refresher started by StartPMTURefresh, if any.
+func StopPMTURefresh(raddr string) {
+	pmtuRefreshersLock.Lock()
+	defer pmtuRefreshersLock.Unlock()
+	if stop, ok := pmtuRefreshers[raddr]; ok {
+		close(stop)
+		delete(pmtuRefreshers, raddr)
+	}
+}
+
+// maybeProbePMTUOnConn runs probePMTUOnConn with default options against
+// conn's own (laddr, raddr) when PMTU probing is enabled, called by
+// DialWithOptions/DialAutoTune right after the raw dial (not before, since
+// the probe needs conn's local port to bind against). On success it caches
+// the discovered MSS under the same (laddr, raddr) key putMSSByAddr uses
+// for conn and returns it, so the caller knows not to overwrite it with
+// conn's own self-reported GetMSS().
+func maybeProbePMTUOnConn(conn net.Conn) (int, bool) {
+	if !isPMTUProbingEnabled() {
+		return 0, false
+	}
+	best, err := probePMTUOnConn(conn, ProbeOptions{})
+	if err != nil {
+		return 0, false
+	}
+	putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), best)
+	return best, true
+}
@@ -0,0 +1,366 @@
+package kcpraw
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ccsexyz/mulcon"
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const proxyDialTimeout = 10 * time.Second
+
+// DialThroughProxy is the mulcon counterpart of DialMulWithOptions for
+// networks where outbound raw/UDP sockets are blocked but a SOCKS5 or
+// HTTP-CONNECT proxy is reachable: each of the mulconn sub-connections is
+// opened through proxyURL instead of raw.DialRAW. SOCKS5 proxies get a
+// UDP-ASSOCIATE so the sub-connections still carry real UDP datagrams;
+// other proxies fall back to a TCP-tunneled framing of the same datagrams.
+func DialThroughProxy(raddr, proxyURL string, block kcp.BlockCrypt, dataShards, parityShards int, password string, mulconn int) (*kcp.UDPSession, error) {
+	err := checkAddr(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checkAddr")
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialThroughProxy url.Parse")
+	}
+
+	dialer := func() (net.Conn, error) {
+		switch u.Scheme {
+		case "socks5", "socks5h":
+			return dialSOCKS5UDPAssociate(u, raddr)
+		case "http", "https":
+			return dialHTTPConnectTunnel(u, raddr)
+		default:
+			return nil, fmt.Errorf("DialThroughProxy: unsupported proxy scheme %q", u.Scheme)
+		}
+	}
+
+	conn, err := mulcon.Dial(dialer, mulconn, mulconMethod, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialThroughProxy")
+	}
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	registerSessionMetrics(sess)
+	return sess, nil
+}
+
+// dialSOCKS5UDPAssociate negotiates a UDP-ASSOCIATE with the SOCKS5 proxy
+// described by u and returns a net.Conn that prepends/strips the SOCKS5 UDP
+// request header on each datagram to/from raddr.
+func dialSOCKS5UDPAssociate(u *url.URL, raddr string) (net.Conn, error) {
+	ctrl, err := net.DialTimeout("tcp", u.Host, proxyDialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate control dial")
+	}
+
+	if err := socks5Handshake(ctrl, u); err != nil {
+		ctrl.Close()
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate handshake")
+	}
+
+	relay, err := socks5Command(ctrl, 0x03 /* UDP ASSOCIATE */, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate associate")
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate ResolveUDPAddr")
+	}
+	relayaddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate relay addr")
+	}
+	udpconn, err := net.DialUDP("udp", nil, relayaddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.Wrap(err, "dialSOCKS5UDPAssociate DialUDP")
+	}
+
+	// The control connection must stay open for the lifetime of the
+	// association; closing the returned conn closes both.
+	return &socks5UDPConn{UDPConn: udpconn, ctrl: ctrl, dst: udpaddr}, nil
+}
+
+func socks5Handshake(conn net.Conn, u *url.URL) error {
+	methods := []byte{0x00} // no auth
+	if u.User != nil {
+		methods = []byte{0x02} // username/password
+	}
+	req := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := fullRead(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return errors.New("socks5: bad version in method selection response")
+	}
+	switch resp[1] {
+	case 0x00:
+		return nil
+	case 0x02:
+		return socks5AuthUserPass(conn, u)
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+}
+
+func socks5AuthUserPass(conn net.Conn, u *url.URL) error {
+	user := u.User.Username()
+	pass, _ := u.User.Password()
+	req := []byte{0x01}
+	req = append(req, byte(len(user)))
+	req = append(req, []byte(user)...)
+	req = append(req, byte(len(pass)))
+	req = append(req, []byte(pass)...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := fullRead(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// socks5Command issues a SOCKS5 request (CONNECT or UDP ASSOCIATE) for
+// target and returns the bound address the proxy reports back.
+func socks5Command(conn net.Conn, cmd byte, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	var port uint16
+	fmt.Sscanf(portStr, "%d", &port)
+
+	req := []byte{0x05, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	} else {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, []byte(host)...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	req = append(req, portBytes...)
+
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := fullRead(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[1] != 0x00 {
+		return "", fmt.Errorf("socks5: command failed with code 0x%02x", hdr[1])
+	}
+
+	var addr string
+	switch hdr[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		if _, err := fullRead(conn, ip); err != nil {
+			return "", err
+		}
+		addr = net.IP(ip).String()
+	case 0x04:
+		ip := make([]byte, 16)
+		if _, err := fullRead(conn, ip); err != nil {
+			return "", err
+		}
+		addr = net.IP(ip).String()
+	case 0x03:
+		lenb := make([]byte, 1)
+		if _, err := fullRead(conn, lenb); err != nil {
+			return "", err
+		}
+		host := make([]byte, lenb[0])
+		if _, err := fullRead(conn, host); err != nil {
+			return "", err
+		}
+		addr = string(host)
+	default:
+		return "", errors.New("socks5: unknown address type in reply")
+	}
+
+	portbuf := make([]byte, 2)
+	if _, err := fullRead(conn, portbuf); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addr, fmt.Sprintf("%d", binary.BigEndian.Uint16(portbuf))), nil
+}
+
+// socks5UDPConn wraps the UDP leg of a SOCKS5 UDP-ASSOCIATE session,
+// framing each datagram with the SOCKS5 UDP request header (RFC 1928
+// section 7) and keeping the TCP control connection alive alongside it.
+type socks5UDPConn struct {
+	*net.UDPConn
+	ctrl net.Conn
+	dst  *net.UDPAddr
+}
+
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+32)
+	n, err := c.UDPConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := parseSocks5UDPDatagram(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, payload), nil
+}
+
+// parseSocks5UDPDatagram strips the SOCKS5 UDP request header (RFC 1928
+// section 7) off the front of a datagram received over the UDP-ASSOCIATE
+// relay, returning the payload that follows it.
+func parseSocks5UDPDatagram(buf []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("socks5UDPConn: short UDP datagram")
+	}
+	payload := buf[3:]
+	switch buf[3] {
+	case 0x01:
+		payload = buf[10:]
+	case 0x04:
+		payload = buf[22:]
+	case 0x03:
+		payload = buf[7+int(buf[4]):]
+	}
+	return payload, nil
+}
+
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	hdr := []byte{0x00, 0x00, 0x00, 0x01}
+	hdr = append(hdr, c.dst.IP.To4()...)
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(c.dst.Port))
+	hdr = append(hdr, portBytes...)
+	_, err := c.UDPConn.Write(append(hdr, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// dialHTTPConnectTunnel falls back to a plain HTTP CONNECT tunnel when the
+// proxy only speaks HTTP: KCP's UDP-shaped datagrams are framed with a
+// 2-byte length prefix over the resulting TCP stream.
+func dialHTTPConnectTunnel(u *url.URL, raddr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, proxyDialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialHTTPConnectTunnel dial")
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: raddr},
+		Host:   raddr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pass)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "dialHTTPConnectTunnel write CONNECT")
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "dialHTTPConnectTunnel read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("dialHTTPConnectTunnel: proxy returned %s", resp.Status)
+	}
+
+	return newLengthPrefixedConn(conn), nil
+}
+
+// lpConn frames each Write with a 2-byte big-endian length prefix so that
+// KCP's discrete datagrams survive being carried over a TCP CONNECT tunnel,
+// and reassembles them the same way on Read.
+type lpConn struct {
+	net.Conn
+	rbuf []byte
+}
+
+func newLengthPrefixedConn(conn net.Conn) *lpConn {
+	return &lpConn{Conn: conn}
+}
+
+func (c *lpConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		hdr := make([]byte, 2)
+		if _, err := fullRead(c.Conn, hdr); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(hdr))
+		payload := make([]byte, n)
+		if _, err := fullRead(c.Conn, payload); err != nil {
+			return 0, err
+		}
+		c.rbuf = payload
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *lpConn) Write(p []byte) (int, error) {
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(len(p)))
+	if _, err := c.Conn.Write(hdr); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func fullRead(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
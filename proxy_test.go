@@ -0,0 +1,57 @@
+package kcpraw
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseSocks5UDPDatagram(t *testing.T) {
+	cases := []struct {
+		name    string
+		buf     []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "ipv4",
+			buf: append([]byte{0x00, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0x1f, 0x90},
+				[]byte("payload")...),
+			want: []byte("payload"),
+		},
+		{
+			name: "ipv6",
+			buf: append(append([]byte{0x00, 0x00, 0x00, 0x04}, make([]byte, 16)...),
+				append([]byte{0x1f, 0x90}, []byte("payload")...)...),
+			want: []byte("payload"),
+		},
+		{
+			name: "domain",
+			buf: append([]byte{0x00, 0x00, 0x00, 0x03, 7}, append([]byte("a.b.c.d"),
+				append([]byte{0x1f, 0x90}, []byte("payload")...)...)...),
+			want: []byte("payload"),
+		},
+		{
+			name:    "too short",
+			buf:     []byte{0x00, 0x00, 0x00},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseSocks5UDPDatagram(c.buf)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got payload %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -86,8 +86,28 @@ func DialWithOptions(raddr string, block kcp.BlockCrypt, dataShards, parityShard
 	if err != nil {
 		return nil, errors.Wrap(err, "net.DialRAW")
 	}
-	putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), conn.GetMSS())
-	return kcp.NewConn(raddr, block, dataShards, parityShards, conn)
+	mss := conn.GetMSS()
+	if probed, ok := maybeProbePMTUOnConn(conn); ok {
+		mss = probed
+	} else {
+		mssCacheLock.Lock()
+		if cached, ok := mssCache[pmtuKey(raddr)]; ok {
+			mss = cached
+		}
+		mssCacheLock.Unlock()
+		putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), mss)
+	}
+	wrapped, err := wrapDialPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapDialPacketConn")
+	}
+	meter := newMeteringConn(wrapped)
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerSessionMetricsWithConn(sess, meter, mss)
+	return sess, nil
 }
 
 func DialMulWithOptions_udp(raddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.UDPSession, error) {
@@ -114,18 +134,30 @@ func DialMulWithOptions(raddr string, block kcp.BlockCrypt, dataShards, paritySh
 	}
 	dialer := func() (conn net.Conn, err error) {
 		rawconn, err := raw.DialRAW(raddr)
-		conn = rawconn
+		if err != nil {
+			return nil, err
+		}
+		conn, err = wrapDialConn(rawconn)
 		return
 	}
 	conn, err := mulcon.Dial(dialer, mulconn, mulconMethod, password)
 	if err != nil {
 		return nil, errors.Wrap(err, "DialMulWithOptions")
 	}
-	return kcp.NewConn(raddr, block, dataShards, parityShards, conn)
+	meter := newMeteringConn(conn)
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerSessionMetricsWithConn(sess, meter, 0)
+	return sess, nil
 }
 
 // ListenWithOptions listens for incoming KCP packets addressed to the local address laddr on the network "udp" with packet encryption,
-// dataShards, parityShards defines Reed-Solomon Erasure Coding parameters
+// dataShards, parityShards defines Reed-Solomon Erasure Coding parameters.
+// The selected Obfuscator's WrapListen still runs per remote peer here (see
+// wrapListenPacketConn/obfsPacketConn), even though all peers share one raw
+// PacketConn.
 func ListenWithOptions(laddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.Listener, error) {
 	err := checkAddr(laddr)
 	if err != nil {
@@ -136,7 +168,17 @@ func ListenWithOptions(laddr string, block kcp.BlockCrypt, dataShards, paritySha
 		return nil, errors.Wrap(err, "net.ListenRAW")
 	}
 	putListenerByAddr(conn.LocalAddr(), conn)
-	return kcp.ServeConn(block, dataShards, parityShards, conn)
+	wrapped, err := wrapListenPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapListenPacketConn")
+	}
+	meter := newMetricsListenPacketConn(wrapped)
+	lis, err := kcp.ServeConn(block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerListenerMetricsWithConn(lis, meter)
+	return lis, nil
 }
 
 func ListenMulWithOptions_udp(laddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.Listener, error) {
@@ -167,7 +209,17 @@ func ListenMulWithOptions(laddr string, block kcp.BlockCrypt, dataShards, parity
 	if err != nil {
 		return nil, errors.Wrap(err, "ListenMulWithOptions")
 	}
-	return kcp.ServeConn(block, dataShards, parityShards, listener)
+	wrapped, err := wrapListenPacketConn(listener)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapListenPacketConn")
+	}
+	meter := newMetricsListenPacketConn(wrapped)
+	lis, err := kcp.ServeConn(block, dataShards, parityShards, meter)
+	if err != nil {
+		return nil, err
+	}
+	registerListenerMetricsWithConn(lis, meter)
+	return lis, nil
 }
 
 // SetNoHTTP determines whether to do http obfuscating
@@ -0,0 +1,310 @@
+package kcpraw
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	stunMagicCookie   = 0x2112A442
+	stunBindingReq    = 0x0001
+	stunBindingResp   = 0x0101
+	stunXorMappedAddr = 0x0020
+	stunMappedAddr    = 0x0001
+	stunTimeout       = 3 * time.Second
+)
+
+var (
+	stunServers     []string
+	stunServersLock sync.Mutex
+
+	stunCache     map[string]*net.UDPAddr
+	stunCacheLock sync.Mutex
+)
+
+func init() {
+	stunCache = make(map[string]*net.UDPAddr)
+}
+
+// SetSTUNServers sets the list of STUN servers (host:port) used by DialWithSTUN
+// and ListenWithSTUN to discover the local public endpoint.
+func SetSTUNServers(servers []string) {
+	stunServersLock.Lock()
+	defer stunServersLock.Unlock()
+	stunServers = servers
+}
+
+func getSTUNServers() []string {
+	stunServersLock.Lock()
+	defer stunServersLock.Unlock()
+	return stunServers
+}
+
+// stunAddrKey mirrors the (laddr,raddr) keying putMSSByAddr/GetMSSByAddr use
+// for mssCache, so a session's discovered public mapping is looked up under
+// the same key its MSS is.
+func stunAddrKey(laddr, raddr net.Addr) string {
+	return laddr.String() + raddr.String()
+}
+
+func getPublicAddrCache(key string) (*net.UDPAddr, bool) {
+	stunCacheLock.Lock()
+	defer stunCacheLock.Unlock()
+	addr, ok := stunCache[key]
+	return addr, ok
+}
+
+func putPublicAddrCache(key string, addr *net.UDPAddr) {
+	stunCacheLock.Lock()
+	defer stunCacheLock.Unlock()
+	stunCache[key] = addr
+}
+
+// GetPublicAddrByAddr returns the public (reflexive) address STUN discovered
+// for the session identified by (laddr, raddr), if DialWithSTUN or
+// ListenWithSTUN has populated it. ListenWithSTUN records its address per
+// local address alone, so for its laddr any raddr finds that entry.
+func GetPublicAddrByAddr(laddr, raddr net.Addr) (*net.UDPAddr, bool) {
+	if addr, ok := getPublicAddrCache(stunAddrKey(laddr, raddr)); ok {
+		return addr, true
+	}
+	return getPublicAddrCache(laddr.String())
+}
+
+// discoverPublicAddr queries the given STUN servers in turn over conn and
+// returns the first successfully discovered public (reflexive) address.
+func discoverPublicAddr(conn *net.UDPConn, servers []string) (*net.UDPAddr, error) {
+	var lastErr error
+	for _, server := range servers {
+		saddr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addr, err := stunBindingRequest(conn, saddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return addr, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no STUN servers configured")
+	}
+	return nil, lastErr
+}
+
+func stunBindingRequest(conn *net.UDPConn, server *net.UDPAddr) (*net.UDPAddr, error) {
+	var txID [12]byte
+	rand.Read(txID[:])
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingReq)
+	binary.BigEndian.PutUint16(req[2:4], 0)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], txID[:])
+
+	conn.SetDeadline(time.Now().Add(stunTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.WriteToUDP(req, server); err != nil {
+		return nil, errors.Wrap(err, "stunBindingRequest WriteToUDP")
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "stunBindingRequest ReadFromUDP")
+	}
+	return parseSTUNResponse(buf[:n], txID)
+}
+
+func parseSTUNResponse(buf []byte, txID [12]byte) (*net.UDPAddr, error) {
+	if len(buf) < 20 {
+		return nil, errors.New("stun response too short")
+	}
+	msgType := binary.BigEndian.Uint16(buf[0:2])
+	if msgType != stunBindingResp {
+		return nil, errors.New("unexpected stun message type")
+	}
+	msgLen := int(binary.BigEndian.Uint16(buf[2:4]))
+	if len(buf) < 20+msgLen {
+		return nil, errors.New("stun response truncated")
+	}
+
+	attrs := buf[20 : 20+msgLen]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		val := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunXorMappedAddr:
+			if addr := parseXorMappedAddr(val); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddr:
+			if addr := parseMappedAddr(val); addr != nil {
+				return addr, nil
+			}
+		}
+		// attributes are padded to a multiple of 4 bytes
+		attrs = attrs[4+((attrLen+3)&^3):]
+	}
+	return nil, errors.New("stun response has no mapped address")
+}
+
+func parseMappedAddr(val []byte) *net.UDPAddr {
+	if len(val) < 8 || val[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(val[2:4])
+	ip := net.IPv4(val[4], val[5], val[6], val[7])
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+func parseXorMappedAddr(val []byte) *net.UDPAddr {
+	if len(val) < 8 || val[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(val[2:4]) ^ uint16(stunMagicCookie>>16)
+	var ipBytes [4]byte
+	binary.BigEndian.PutUint32(ipBytes[:], binary.BigEndian.Uint32(val[4:8])^stunMagicCookie)
+	return &net.UDPAddr{IP: net.IP(ipBytes[:]), Port: int(port)}
+}
+
+// holePunch sends five punch datagrams to raddr, 20ms apart, so that
+// intermediate NATs install a mapping toward it, then lets the caller
+// continue with the regular raw dial. It reads no reply from raddr and does
+// not coordinate the punch with the peer.
+func holePunch(conn *net.UDPConn, raddr *net.UDPAddr) {
+	punch := []byte("kcpraw-punch")
+	for i := 0; i < 5; i++ {
+		conn.WriteToUDP(punch, raddr)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// soReuseport is SO_REUSEPORT's numeric value on Linux for most
+// architectures, amd64 included; mips, whose value is 0x200, is not
+// covered by it. The standard
+// syscall package only defines this constant for a handful of GOARCHes
+// (arm64, mips, ppc64, riscv64, s390x) and notably not for amd64, so it is
+// hardcoded here rather than referenced as syscall.SO_REUSEPORT.
+const soReuseport = 0xf
+
+// reusePortListenUDP opens a plain UDP socket bound to the exact same local
+// address the raw socket at addr is already using (via SO_REUSEADDR +
+// SO_REUSEPORT), so STUN discovery and the hole punch mutate the NAT
+// mapping that the real, subsequently-used raw connection will reuse,
+// instead of a throwaway socket the raw conn has nothing to do with.
+func reusePortListenUDP(addr net.Addr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReuseport, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// DialWithSTUN discovers the local public endpoint via the given STUN
+// servers and performs a simultaneous-open hole punch with raddr, both on
+// the exact local port that raw.DialRAW has already bound for this session
+// (via reusePortListenUDP), then hands that same raw connection to KCP. If
+// STUN discovery or the punch fails, the raw dial still proceeds normally.
+func DialWithSTUN(raddr string, stunServers []string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.UDPSession, error) {
+	err := checkAddr(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checkAddr")
+	}
+	if len(stunServers) == 0 {
+		stunServers = getSTUNServers()
+	}
+
+	conn, err := raw.DialRAW(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.DialRAW")
+	}
+	putMSSByAddr(conn.LocalAddr(), conn.RemoteAddr(), conn.GetMSS())
+
+	if udpaddr, uerr := net.ResolveUDPAddr("udp4", raddr); uerr == nil {
+		if probe, perr := reusePortListenUDP(conn.LocalAddr()); perr == nil {
+			if pub, serr := discoverPublicAddr(probe, stunServers); serr == nil {
+				putPublicAddrCache(stunAddrKey(conn.LocalAddr(), conn.RemoteAddr()), pub)
+			}
+			holePunch(probe, udpaddr)
+			probe.Close()
+		}
+	}
+
+	wrapped, err := wrapDialPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapDialPacketConn")
+	}
+	sess, err := kcp.NewConn(raddr, block, dataShards, parityShards, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	registerSessionMetrics(sess)
+	return sess, nil
+}
+
+// ListenWithSTUN is the listening counterpart of DialWithSTUN: it discovers
+// the public endpoint of the exact local address raw.ListenRAW bound to,
+// registers it so GetPublicAddrByAddr can hand it to peers for rendezvous,
+// and then serves KCP connections the same way ListenWithOptions does.
+func ListenWithSTUN(laddr string, stunServers []string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.Listener, error) {
+	err := checkAddr(laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checkAddr")
+	}
+	if len(stunServers) == 0 {
+		stunServers = getSTUNServers()
+	}
+
+	conn, err := raw.ListenRAW(laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenRAW")
+	}
+	putListenerByAddr(conn.LocalAddr(), conn)
+
+	if probe, perr := reusePortListenUDP(conn.LocalAddr()); perr == nil {
+		if pub, serr := discoverPublicAddr(probe, stunServers); serr == nil {
+			putPublicAddrCache(conn.LocalAddr().String(), pub)
+		}
+		probe.Close()
+	}
+
+	wrapped, err := wrapListenPacketConn(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapListenPacketConn")
+	}
+	lis, err := kcp.ServeConn(block, dataShards, parityShards, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	registerListenerMetrics(lis)
+	return lis, nil
+}
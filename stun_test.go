@@ -0,0 +1,93 @@
+package kcpraw
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func buildSTUNResponse(txID [12]byte, attrType uint16, attrVal []byte) []byte {
+	pad := (4 - len(attrVal)%4) % 4
+	attrs := make([]byte, 4+len(attrVal)+pad)
+	binary.BigEndian.PutUint16(attrs[0:2], attrType)
+	binary.BigEndian.PutUint16(attrs[2:4], uint16(len(attrVal)))
+	copy(attrs[4:], attrVal)
+
+	buf := make([]byte, 20+len(attrs))
+	binary.BigEndian.PutUint16(buf[0:2], stunBindingResp)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(buf[4:8], stunMagicCookie)
+	copy(buf[8:20], txID[:])
+	copy(buf[20:], attrs)
+	return buf
+}
+
+func TestParseSTUNResponseMappedAddr(t *testing.T) {
+	var txID [12]byte
+	val := []byte{0x00, 0x01, 0x1f, 0x90, 203, 0, 113, 42}
+	buf := buildSTUNResponse(txID, stunMappedAddr, val)
+
+	addr, err := parseSTUNResponse(buf, txID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 42), Port: 0x1f90}
+	if addr.Port != want.Port || !addr.IP.Equal(want.IP) {
+		t.Fatalf("got %v, want %v", addr, want)
+	}
+}
+
+func TestParseSTUNResponseXorMappedAddr(t *testing.T) {
+	var txID [12]byte
+	port := uint16(0x1f90) ^ uint16(stunMagicCookie>>16)
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32([]byte{203, 0, 113, 42})^stunMagicCookie)
+	val := make([]byte, 8)
+	val[1] = 0x01
+	binary.BigEndian.PutUint16(val[2:4], port)
+	copy(val[4:8], ip[:])
+	buf := buildSTUNResponse(txID, stunXorMappedAddr, val)
+
+	addr, err := parseSTUNResponse(buf, txID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 42), Port: 0x1f90}
+	if addr.Port != want.Port || !addr.IP.Equal(want.IP) {
+		t.Fatalf("got %v, want %v", addr, want)
+	}
+}
+
+func TestParseSTUNResponseErrors(t *testing.T) {
+	var txID [12]byte
+	cases := []struct {
+		name string
+		buf  []byte
+	}{
+		{"too short", make([]byte, 10)},
+		{"wrong message type", func() []byte {
+			buf := buildSTUNResponse(txID, stunMappedAddr, []byte{0x00, 0x01, 0x1f, 0x90, 1, 2, 3, 4})
+			binary.BigEndian.PutUint16(buf[0:2], stunBindingReq)
+			return buf
+		}()},
+		{"no mapped address attr", buildSTUNResponse(txID, 0x9999, []byte{1, 2, 3, 4})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := parseSTUNResponse(c.buf, txID); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseMappedAddr(t *testing.T) {
+	if addr := parseMappedAddr([]byte{0x00, 0x01}); addr != nil {
+		t.Fatalf("expected nil for short input, got %v", addr)
+	}
+	val := []byte{0x00, 0x01, 0x1f, 0x90, 10, 0, 0, 1}
+	addr := parseMappedAddr(val)
+	if addr == nil || addr.Port != 0x1f90 || !addr.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("got %v", addr)
+	}
+}
@@ -0,0 +1,153 @@
+package kcpraw
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+const (
+	wsOpBinary   = 0x2
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxPayload = 65535
+)
+
+// wsConn wraps a net.Conn so that every Write is framed as a WebSocket
+// binary message and every Read unwraps one, letting KCP treat it as an
+// ordinary byte stream.
+type wsConn struct {
+	net.Conn
+	masked bool // true on the client side, per RFC 6455
+	rbuf   []byte
+}
+
+func newWSConn(conn net.Conn, masked bool) *wsConn {
+	return &wsConn{Conn: conn, masked: masked}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = payload
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *wsConn) readFrame() ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+		return nil, err
+	}
+	payloadLen := int(hdr[1] &^ 0x80)
+	masked := hdr[1]&0x80 != 0
+
+	switch {
+	case payloadLen == 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, ext); err != nil {
+			return nil, err
+		}
+		payloadLen = int(binary.BigEndian.Uint16(ext))
+	case payloadLen == 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.Conn, ext); err != nil {
+			return nil, err
+		}
+		payloadLen = int(binary.BigEndian.Uint64(ext))
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.Conn, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return payload, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if n > wsMaxPayload {
+			n = wsMaxPayload
+		}
+		if err := c.writeFrame(p[:n]); err != nil {
+			return 0, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (c *wsConn) writeFrame(payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|wsOpBinary) // FIN + binary opcode
+
+	maskBit := byte(0)
+	if c.masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(len(payload)))
+		frame = append(frame, maskBit|126)
+		frame = append(frame, ext...)
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext...)
+	}
+
+	if c.masked {
+		var maskKey [4]byte
+		rand.Read(maskKey[:])
+		frame = append(frame, maskKey[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ maskKey[i%4]
+		}
+		frame = append(frame, masked...)
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func wsBase64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for a given
+// Sec-WebSocket-Key, per RFC 6455 section 1.3.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
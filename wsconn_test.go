@@ -0,0 +1,55 @@
+package kcpraw
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWSConnRoundTrip(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	client := newWSConn(clientRaw, true)
+	server := newWSConn(serverRaw, false)
+
+	messages := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("x"), 200),   // forces the 126-length-prefix form
+		bytes.Repeat([]byte("y"), 70000), // over wsMaxPayload: Write splits it into two 126-length-prefix frames
+	}
+
+	for _, want := range messages {
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.Write(want)
+			done <- err
+		}()
+
+		got := make([]byte, len(want))
+		if _, err := readFull(server, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("round trip mismatch for len %d", len(want))
+		}
+	}
+}
+
+func readFull(c net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}